@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/color/palette"
+	"image/draw"
+	"image/gif"
+	"path/filepath"
+	"strings"
+
+	"github.com/disintegration/imaging"
+)
+
+// generateAnimatedGIFThumbnail resizes every frame of an animated GIF and
+// re-encodes it as an animated GIF thumbnail, preserving delays and loop
+// count. GIF frames are only sub-rectangles of the logical canvas, not
+// pre-composited full frames, so each is first painted onto a running
+// canvas per its Disposal before resizing; see composeGIFFrames. WebP
+// animation is not supported by our decoder: a still WebP goes through the
+// regular static variant pipeline, and an animated WebP fails to decode,
+// so processFile rejects it and no thumbnail is generated.
+func generateAnimatedGIFThumbnail(filename string, src *gif.GIF) ([]Variant, string, error) {
+	ctx := context.Background()
+
+	size := smallestVariantSize()
+
+	out := &gif.GIF{
+		LoopCount: src.LoopCount,
+		Delay:     append([]int(nil), src.Delay...),
+		Disposal:  append([]byte(nil), src.Disposal...),
+	}
+
+	for _, frame := range composeGIFFrames(src) {
+		resized := imaging.Thumbnail(frame, size, size, imaging.CatmullRom)
+
+		paletted := image.NewPaletted(resized.Bounds(), palette.Plan9)
+		draw.FloydSteinberg.Draw(paletted, resized.Bounds(), resized, image.Point{})
+
+		out.Image = append(out.Image, paletted)
+	}
+
+	var buf bytes.Buffer
+	if err := gif.EncodeAll(&buf, out); err != nil {
+		return nil, "", err
+	}
+
+	base := strings.TrimSuffix(filepath.Base(filename), filepath.Ext(filename))
+	thumbnailFilename := base + ".gif"
+
+	if err := objects.Put(ctx, thumbnailKey(thumbnailFilename), bytes.NewReader(buf.Bytes()), "image/gif"); err != nil {
+		return nil, "", err
+	}
+
+	bounds := out.Image[0].Bounds()
+	variant := Variant{
+		Size:     size,
+		Format:   "gif",
+		Filename: thumbnailFilename,
+		Width:    bounds.Dx(),
+		Height:   bounds.Dy(),
+		Bytes:    int64(buf.Len()),
+	}
+
+	return []Variant{variant}, thumbnailFilename, nil
+}
+
+// composeGIFFrames renders each frame of src onto a running RGBA canvas the
+// size of the logical GIF canvas, honoring each frame's Disposal, and
+// returns one fully-composited image per frame. Without this, frames that
+// only encode the region that changed since the last frame (as produced by
+// ffmpeg, gifsicle, and most GIF optimizers) would be resized in isolation,
+// scaling a small changed region up to fill the whole thumbnail.
+func composeGIFFrames(src *gif.GIF) []*image.RGBA {
+	canvas := image.NewRGBA(image.Rect(0, 0, src.Config.Width, src.Config.Height))
+	var previous *image.RGBA
+
+	frames := make([]*image.RGBA, len(src.Image))
+	for i, frame := range src.Image {
+		disposal := byte(gif.DisposalNone)
+		if i < len(src.Disposal) {
+			disposal = src.Disposal[i]
+		}
+
+		if disposal == gif.DisposalPrevious {
+			previous = copyRGBA(canvas)
+		}
+
+		draw.Draw(canvas, frame.Bounds(), frame, frame.Bounds().Min, draw.Over)
+		frames[i] = copyRGBA(canvas)
+
+		switch disposal {
+		case gif.DisposalBackground:
+			draw.Draw(canvas, frame.Bounds(), image.Transparent, image.Point{}, draw.Src)
+		case gif.DisposalPrevious:
+			if previous != nil {
+				canvas = previous
+			}
+		}
+	}
+	return frames
+}
+
+// copyRGBA returns an independent copy of src, used so later disposal of the
+// running canvas can't retroactively mutate a frame already handed out.
+func copyRGBA(src *image.RGBA) *image.RGBA {
+	dst := image.NewRGBA(src.Bounds())
+	draw.Draw(dst, dst.Bounds(), src, src.Bounds().Min, draw.Src)
+	return dst
+}
+
+// smallestVariantSize returns the smallest configured thumbnail size, used
+// as the single size generated for animated GIF thumbnails.
+func smallestVariantSize() int {
+	specs := cfg.Thumbnails.Variants
+	if len(specs) == 0 {
+		specs = defaultVariantSpecs
+	}
+
+	size := specs[0].Size
+	for _, s := range specs[1:] {
+		if s.Size < size {
+			size = s.Size
+		}
+	}
+	return size
+}
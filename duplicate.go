@@ -0,0 +1,126 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// defaultHashThreshold is the maximum Hamming distance between two
+// perceptual hashes for images to be considered near-duplicates.
+const defaultHashThreshold = 5
+
+// defaultSimilarLimit bounds how many nearest neighbors getSimilarImages
+// returns when the caller doesn't specify one.
+const defaultSimilarLimit = 20
+
+type nearDuplicate struct {
+	ID       int
+	Filename string
+	Distance int
+}
+
+// findNearDuplicate looks for an existing image whose dHash or pHash is
+// within threshold bits of the given hashes, returning the closest match.
+func findNearDuplicate(dhash, phash uint64, threshold int) (*nearDuplicate, error) {
+	row := db.QueryRow(`
+		SELECT id, filename, LEAST(bit_count(dhash # $1), bit_count(phash # $2)) AS distance
+		FROM images
+		WHERE bit_count(dhash # $1) <= $3 OR bit_count(phash # $2) <= $3
+		ORDER BY distance ASC
+		LIMIT 1
+	`, int64(dhash), int64(phash), threshold)
+
+	var dup nearDuplicate
+	err := row.Scan(&dup.ID, &dup.Filename, &dup.Distance)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &dup, nil
+}
+
+func similarHandler(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid id"})
+		return
+	}
+
+	threshold := defaultHashThreshold
+	if t := c.Query("threshold"); t != "" {
+		threshold, err = strconv.Atoi(t)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid threshold"})
+			return
+		}
+	}
+
+	limit := defaultSimilarLimit
+	if l := c.Query("limit"); l != "" {
+		limit, err = strconv.Atoi(l)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid limit"})
+			return
+		}
+	}
+
+	images, err := getSimilarImages(id, threshold, limit)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch similar images"})
+		return
+	}
+
+	c.JSON(http.StatusOK, images)
+}
+
+// getSimilarImages returns the k nearest images to id by perceptual hash
+// Hamming distance, closest first, excluding matches beyond threshold.
+func getSimilarImages(id, threshold, limit int) ([]ImageInfo, error) {
+	query := `
+		SELECT a.id, a.filename, a.thumbnail_filename, a.width, a.height, a.sha256sum, a.upload_date,
+			LEAST(bit_count(a.dhash # b.dhash), bit_count(a.phash # b.phash)) AS distance
+		FROM images a, images b
+		WHERE b.id = $1 AND a.id != b.id
+			AND LEAST(bit_count(a.dhash # b.dhash), bit_count(a.phash # b.phash)) <= $2
+		ORDER BY distance ASC
+		LIMIT $3
+	`
+
+	rows, err := db.Query(query, id, threshold, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var images []ImageInfo
+	for rows.Next() {
+		var img ImageInfo
+		err := rows.Scan(
+			&img.ID,
+			&img.Filename,
+			&img.ThumbnailFilename,
+			&img.Width,
+			&img.Height,
+			&img.SHA256Sum,
+			&img.UploadDate,
+			&img.Distance,
+		)
+		if err != nil {
+			return nil, err
+		}
+		img.ThumbnailPath = objects.URL(thumbnailKey(img.ThumbnailFilename))
+		img.ImagePath = objects.URL(imageKey(img.Filename))
+		images = append(images, img)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return images, nil
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"time"
+
+	"github.com/disintegration/imaging"
+	"github.com/rwcarlsen/goexif/exif"
+)
+
+// imageMetadata holds the EXIF fields extracted from an upload and
+// persisted alongside it.
+type imageMetadata struct {
+	Orientation int
+	CameraMake  string
+	CameraModel string
+	TakenAt     *time.Time
+	GPSLat      *float64
+	GPSLon      *float64
+}
+
+// readMetadata extracts orientation, camera, capture time, and (unless
+// config disables it) GPS coordinates from r's EXIF data. A missing or
+// unparsable EXIF segment is not an error: it just leaves the defaults
+// (orientation 1, everything else empty).
+func readMetadata(r io.Reader) imageMetadata {
+	meta := imageMetadata{Orientation: 1}
+
+	x, err := exif.Decode(r)
+	if err != nil {
+		return meta
+	}
+
+	if tag, err := x.Get(exif.Orientation); err == nil {
+		if v, err := tag.Int(0); err == nil {
+			meta.Orientation = v
+		}
+	}
+	if tag, err := x.Get(exif.Make); err == nil {
+		if v, err := tag.StringVal(); err == nil {
+			meta.CameraMake = v
+		}
+	}
+	if tag, err := x.Get(exif.Model); err == nil {
+		if v, err := tag.StringVal(); err == nil {
+			meta.CameraModel = v
+		}
+	}
+	if t, err := x.DateTime(); err == nil {
+		meta.TakenAt = &t
+	}
+	if !cfg.Exif.StripGPS {
+		if lat, lon, err := x.LatLong(); err == nil {
+			meta.GPSLat = &lat
+			meta.GPSLon = &lon
+		}
+	}
+
+	return meta
+}
+
+// applyOrientation rotates/flips img per the EXIF orientation tag (1-8),
+// matching imaging.AutoOrient's transform table.
+func applyOrientation(img image.Image, orientation int) image.Image {
+	switch orientation {
+	case 2:
+		return imaging.FlipH(img)
+	case 3:
+		return imaging.Rotate180(img)
+	case 4:
+		return imaging.FlipV(img)
+	case 5:
+		return imaging.Transpose(img)
+	case 6:
+		return imaging.Rotate270(img)
+	case 7:
+		return imaging.Transverse(img)
+	case 8:
+		return imaging.Rotate90(img)
+	default:
+		return img
+	}
+}
+
+// encodeClean re-encodes img in format ("jpeg" or "png"). Since it is
+// built from the decoded pixel buffer rather than copied from the
+// original file, the result carries no EXIF, XMP, or IPTC segments.
+func encodeClean(img image.Image, format string) ([]byte, error) {
+	var buf bytes.Buffer
+
+	var err error
+	if format == "png" {
+		err = png.Encode(&buf, img)
+	} else {
+		err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: 90})
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
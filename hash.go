@@ -0,0 +1,123 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"math"
+	"sort"
+
+	"github.com/disintegration/imaging"
+)
+
+// dHash computes a 64-bit difference hash by resizing img to 9x8 grayscale
+// and setting bit i to 1 iff pixel[i] > pixel[i+1] along each row.
+func dHash(img image.Image) uint64 {
+	small := imaging.Resize(imaging.Grayscale(img), 9, 8, imaging.Lanczos)
+
+	var hash uint64
+	bit := uint(0)
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			left := grayAt(small, x, y)
+			right := grayAt(small, x+1, y)
+			if left > right {
+				hash |= 1 << bit
+			}
+			bit++
+		}
+	}
+	return hash
+}
+
+// pHash computes a 63-bit perceptual hash from a 32x32 DCT of img, keeping
+// the top-left 8x8 low-frequency coefficients (excluding the DC term) and
+// thresholding each at the median of that block.
+func pHash(img image.Image) uint64 {
+	const size = 32
+	const block = 8
+
+	small := imaging.Resize(imaging.Grayscale(img), size, size, imaging.Lanczos)
+
+	pixels := make([][]float64, size)
+	for y := 0; y < size; y++ {
+		pixels[y] = make([]float64, size)
+		for x := 0; x < size; x++ {
+			pixels[y][x] = float64(grayAt(small, x, y))
+		}
+	}
+
+	coeffs := dct2D(pixels, size)
+
+	vals := make([]float64, 0, block*block-1)
+	for y := 0; y < block; y++ {
+		for x := 0; x < block; x++ {
+			if x == 0 && y == 0 {
+				continue
+			}
+			vals = append(vals, coeffs[y][x])
+		}
+	}
+	median := medianOf(vals)
+
+	var hash uint64
+	bit := uint(0)
+	for y := 0; y < block; y++ {
+		for x := 0; x < block; x++ {
+			if x == 0 && y == 0 {
+				continue
+			}
+			if coeffs[y][x] > median {
+				hash |= 1 << bit
+			}
+			bit++
+		}
+	}
+	return hash
+}
+
+func grayAt(img image.Image, x, y int) uint8 {
+	return color.GrayModel.Convert(img.At(x, y)).(color.Gray).Y
+}
+
+// dct2D returns the 2D type-II discrete cosine transform of an n x n block.
+func dct2D(pixels [][]float64, n int) [][]float64 {
+	result := make([][]float64, n)
+	for i := range result {
+		result[i] = make([]float64, n)
+	}
+
+	for v := 0; v < n; v++ {
+		for u := 0; u < n; u++ {
+			var sum float64
+			for y := 0; y < n; y++ {
+				for x := 0; x < n; x++ {
+					sum += pixels[y][x] *
+						math.Cos(math.Pi/float64(n)*(float64(x)+0.5)*float64(u)) *
+						math.Cos(math.Pi/float64(n)*(float64(y)+0.5)*float64(v))
+				}
+			}
+			cu, cv := 1.0, 1.0
+			if u == 0 {
+				cu = 1 / math.Sqrt2
+			}
+			if v == 0 {
+				cv = 1 / math.Sqrt2
+			}
+			result[v][u] = 0.25 * cu * cv * sum
+		}
+	}
+	return result
+}
+
+func medianOf(vals []float64) float64 {
+	if len(vals) == 0 {
+		return 0
+	}
+	sorted := append([]float64(nil), vals...)
+	sort.Float64s(sorted)
+	mid := len(sorted) / 2
+	if len(sorted)%2 == 0 {
+		return (sorted[mid-1] + sorted[mid]) / 2
+	}
+	return sorted[mid]
+}
@@ -1,29 +1,32 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"crypto/sha256"
 	"database/sql"
 	"encoding/hex"
 	"fmt"
 	"image"
+	"image/gif"
 	_ "image/jpeg"
 	_ "image/png"
 	"io"
 	"log"
-	"mime/multipart"
+	"mime"
 	"net/http"
 	"os"
+	"path"
 	"path/filepath"
+	"strings"
 
-	"github.com/disintegration/imaging"
 	"github.com/gin-gonic/gin"
 	_ "github.com/lib/pq"
+	_ "golang.org/x/image/webp"
 	"gopkg.in/yaml.v2"
 )
 
 const (
-	uploadDir     = "./image"
-	thumbnailDir  = "./thumb"
 	maxUploadSize = 40 * 1024 * 1024 // 40MB
 )
 
@@ -36,23 +39,60 @@ type Config struct {
 		Port     int    `yaml:"port"`
 		SSLMode  string `yaml:"sslmode"`
 	} `yaml:"database"`
+	PerceptualHash struct {
+		Threshold int `yaml:"threshold"`
+	} `yaml:"perceptual_hash"`
+	Storage    StorageConfig    `yaml:"storage"`
+	Thumbnails ThumbnailsConfig `yaml:"thumbnails"`
+	Exif       ExifConfig       `yaml:"exif"`
+}
+
+// ExifConfig controls how EXIF metadata extracted from uploads is handled.
+type ExifConfig struct {
+	StripGPS bool `yaml:"strip_gps"`
+}
+
+// ThumbnailsConfig configures the set of thumbnail sizes/formats produced
+// for each upload. See defaultVariantSpecs for the fallback.
+type ThumbnailsConfig struct {
+	Variants []VariantSpec `yaml:"variants"`
+}
+
+// StorageConfig selects and configures the Storage backend. Type is
+// "local" (the default) or "s3"; the remaining fields only apply to s3.
+type StorageConfig struct {
+	Type                 string `yaml:"type"`
+	Bucket               string `yaml:"bucket"`
+	Endpoint             string `yaml:"endpoint"`
+	Region               string `yaml:"region"`
+	AccessKey            string `yaml:"access_key"`
+	SecretKey            string `yaml:"secret_key"`
+	UseSSL               bool   `yaml:"use_ssl"`
+	PresignExpirySeconds int    `yaml:"presign_expiry_seconds"`
 }
 
 type ImageInfo struct {
-	ID                int    `json:"id"`
-	Filename          string `json:"filename"`
-	ThumbnailFilename string `json:"thumbnail_filename"`
-	Width             int    `json:"width"`
-	Height            int    `json:"height"`
-	SHA256Sum         string `json:"sha256sum"`
-	UploadDate        string `json:"upload_date"`
-	ThumbnailPath     string `json:"thumbnail_path"`
-	ImagePath         string `json:"image_path"`
+	ID                int       `json:"id"`
+	Filename          string    `json:"filename"`
+	ThumbnailFilename string    `json:"thumbnail_filename"`
+	Width             int       `json:"width"`
+	Height            int       `json:"height"`
+	SHA256Sum         string    `json:"sha256sum"`
+	UploadDate        string    `json:"upload_date"`
+	ThumbnailPath     string    `json:"thumbnail_path"`
+	ImagePath         string    `json:"image_path"`
+	Distance          int       `json:"distance,omitempty"`
+	Variants          []Variant `json:"variants,omitempty"`
+	Format            string    `json:"format"`
+	Frames            int       `json:"frames"`
+	DurationMs        int       `json:"duration_ms"`
+	Animated          bool      `json:"animated"`
 }
 
 var (
-	db  *sql.DB
-	cfg Config
+	db      *sql.DB
+	cfg     Config
+	objects Storage
 )
 
 func loadConfig() error {
@@ -95,12 +135,38 @@ func main() {
 		log.Fatal("Failed to connect to database:", err)
 	}
 
+	if err := ensureSchema(); err != nil {
+		log.Fatal(err)
+	}
+
+	objects, err = newStorage(cfg.Storage)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if localStore, ok := objects.(*localStorage); ok {
+		if err := migrateToShardedLayout(localStore); err != nil {
+			log.Fatal(err)
+		}
+	}
+
 	router := gin.Default()
 	router.LoadHTMLGlob("templates/*")
-	router.Static("/image", "./image")
-	router.Static("/thumb", "./thumb")
+	if _, ok := objects.(*localStorage); ok {
+		router.GET("/image/*key", serveImageHandler)
+		router.GET("/thumb/*key", serveThumbnailHandler)
+	}
 	router.POST("/upload", uploadHandler)
 	router.GET("/view", viewHandler)
+	router.GET("/similar/:id", similarHandler)
+	router.POST("/files", tusCreateHandler)
+	router.OPTIONS("/files", tusOptionsHandler)
+	router.HEAD("/files/:id", tusHeadHandler)
+	router.PATCH("/files/:id", tusPatchHandler)
+	router.DELETE("/files/:id", tusDeleteHandler)
+
+	go runPendingUploadJanitor(pendingJanitorInterval)
+
 	router.Run(":8080")
 }
 
@@ -116,7 +182,15 @@ func uploadHandler(c *gin.Context) {
 	responses := make([]gin.H, 0)
 
 	for _, file := range files {
-		response, statusCode := processFile(file)
+		src, err := file.Open()
+		if err != nil {
+			responses = append(responses, gin.H{"error": err.Error(), "filename": file.Filename})
+			c.JSON(http.StatusInternalServerError, responses)
+			return
+		}
+
+		response, statusCode := processFile(src, file.Size, file.Filename)
+		src.Close()
 		response["filename"] = file.Filename
 		responses = append(responses, response)
 
@@ -129,25 +203,23 @@ func uploadHandler(c *gin.Context) {
 	c.JSON(http.StatusOK, responses)
 }
 
-func processFile(file *multipart.FileHeader) (gin.H, int) {
-	if file.Size > maxUploadSize {
+// processFile runs the shared ingest pipeline (MIME sniff, dedup, thumbnail
+// generation, DB insert) against src, which must be positioned at offset 0
+// and contain exactly size bytes. Both the regular multipart upload and the
+// tus resumable upload handlers funnel completed files through this.
+func processFile(src io.ReadSeeker, size int64, originalFilename string) (gin.H, int) {
+	if size > maxUploadSize {
 		return gin.H{"error": "File too large"}, http.StatusBadRequest
 	}
 
-	src, err := file.Open()
-	if err != nil {
-		return gin.H{"error": err.Error()}, http.StatusInternalServerError
-	}
-	defer src.Close()
-
 	buff := make([]byte, 512)
-	_, err = src.Read(buff)
+	_, err := src.Read(buff)
 	if err != nil {
 		return gin.H{"error": "Failed to read file"}, http.StatusInternalServerError
 	}
 	filetype := http.DetectContentType(buff)
-	if filetype != "image/jpeg" && filetype != "image/png" {
-		return gin.H{"error": "File type not allowed. Only JPG and PNG are allowed."}, http.StatusBadRequest
+	if filetype != "image/jpeg" && filetype != "image/png" && filetype != "image/gif" && filetype != "image/webp" {
+		return gin.H{"error": "File type not allowed. Only JPG, PNG, GIF, and WEBP are allowed."}, http.StatusBadRequest
 	}
 
 	src.Seek(0, 0)
@@ -168,68 +240,153 @@ func processFile(file *multipart.FileHeader) (gin.H, int) {
 	}
 
 	src.Seek(0, 0)
+	raw, err := io.ReadAll(src)
+	if err != nil {
+		return gin.H{"error": "Failed to read file"}, http.StatusInternalServerError
+	}
+	var meta imageMetadata
+	if filetype == "image/jpeg" || filetype == "image/png" {
+		meta = readMetadata(bytes.NewReader(raw))
+	} else {
+		meta = imageMetadata{Orientation: 1}
+	}
+
+	decoded, format, err := image.Decode(bytes.NewReader(raw))
+	if err != nil {
+		return gin.H{"error": "Failed to decode image"}, http.StatusInternalServerError
+	}
+	oriented := applyOrientation(decoded, meta.Orientation)
+
+	dhash := dHash(oriented)
+	phash := pHash(oriented)
+
+	threshold := cfg.PerceptualHash.Threshold
+	if threshold <= 0 {
+		threshold = defaultHashThreshold
+	}
 
-	filename := sha256sum + filepath.Ext(file.Filename)
-	if err := saveFile(src, filename); err != nil {
+	dup, err := findNearDuplicate(dhash, phash, threshold)
+	if err != nil {
+		return gin.H{"error": "Database error"}, http.StatusInternalServerError
+	}
+	if dup != nil {
+		return gin.H{
+			"error":    "A visually similar image already exists",
+			"id":       dup.ID,
+			"filename": dup.Filename,
+			"distance": dup.Distance,
+		}, http.StatusConflict
+	}
+
+	var clean []byte
+	if format == "jpeg" || format == "png" {
+		clean, err = encodeClean(oriented, format)
+		if err != nil {
+			return gin.H{"error": "Failed to re-encode image"}, http.StatusInternalServerError
+		}
+	} else {
+		// GIF and WebP are stored as uploaded: we can't yet rebuild their
+		// container (animation, loop count) through a stdlib encoder.
+		clean = raw
+	}
+
+	frames, durationMs, animated := 1, 0, false
+	if format == "gif" {
+		if g, err := gif.DecodeAll(bytes.NewReader(raw)); err == nil {
+			frames = len(g.Image)
+			for _, d := range g.Delay {
+				durationMs += d * 10
+			}
+			animated = frames > 1
+		}
+	}
+
+	ctx := context.Background()
+	filename := sha256sum + filepath.Ext(originalFilename)
+
+	if err := objects.Put(ctx, imageKey(filename), bytes.NewReader(clean), filetype); err != nil {
 		return gin.H{"error": "Failed to save file"}, http.StatusInternalServerError
 	}
 
-	thumbnailFilename, err := generateThumbnail(filename)
+	variants, thumbnailFilename, err := generateVariants(filename)
 	if err != nil {
 		return gin.H{"error": "Failed to generate thumbnail"}, http.StatusInternalServerError
 	}
 
-	if err := saveToDatabase(filename, thumbnailFilename, sha256sum); err != nil {
+	bounds := oriented.Bounds()
+	imageID, err := saveToDatabase(filename, thumbnailFilename, sha256sum, dhash, phash, bounds.Dx(), bounds.Dy(), meta, format, frames, durationMs, animated)
+	if err != nil {
 		return gin.H{"error": "Failed to save to database"}, http.StatusInternalServerError
 	}
 
+	if err := saveVariants(imageID, variants); err != nil {
+		return gin.H{"error": "Failed to save image variants"}, http.StatusInternalServerError
+	}
+
 	return gin.H{"message": "File uploaded successfully", "sha256sum": sha256sum}, http.StatusOK
 }
 
-func saveFile(file multipart.File, filename string) error {
-	dst, err := os.Create(filepath.Join(uploadDir, filename))
-	if err != nil {
-		return err
-	}
-	defer dst.Close()
+func serveImageHandler(c *gin.Context) {
+	serveObject(c, imagePrefix, c.Param("key"))
+}
 
-	_, err = io.Copy(dst, file)
-	return err
+func serveThumbnailHandler(c *gin.Context) {
+	serveObject(c, thumbnailPrefix, c.Param("key"))
 }
 
-func generateThumbnail(filename string) (string, error) {
-	src, err := imaging.Open(filepath.Join(uploadDir, filename))
-	if err != nil {
-		return "", err
+func serveObject(c *gin.Context, prefix, key string) {
+	trimmed := strings.TrimPrefix(key, "/")
+	fullKey := path.Join(prefix, trimmed)
+	if fullKey != prefix && !strings.HasPrefix(fullKey, prefix+"/") {
+		c.Status(http.StatusNotFound)
+		return
 	}
 
-	thumbnail := imaging.Thumbnail(src, 120, 120, imaging.CatmullRom)
-
-	thumbnailFilename := filepath.Base(filename)
-	thumbnailFilename = thumbnailFilename[:len(thumbnailFilename)-len(filepath.Ext(thumbnailFilename))] + ".jpg"
-	err = imaging.Save(thumbnail, filepath.Join(thumbnailDir, thumbnailFilename))
+	r, err := objects.Get(c.Request.Context(), fullKey)
 	if err != nil {
-		return "", err
+		// Pre-sharding URLs point straight at prefix/<filename>; migrateToShardedLayout
+		// relocates the file but leaves those links pointing at the now-empty flat path.
+		// Fall back to the sharded location before giving up.
+		shardedKey := path.Join(prefix, shardKey(trimmed))
+		if shardedKey == fullKey {
+			c.Status(http.StatusNotFound)
+			return
+		}
+		r, err = objects.Get(c.Request.Context(), shardedKey)
+		if err != nil {
+			c.Status(http.StatusNotFound)
+			return
+		}
+		fullKey = shardedKey
 	}
+	defer r.Close()
 
-	return thumbnailFilename, nil
+	c.Header("Content-Type", mime.TypeByExtension(filepath.Ext(fullKey)))
+	io.Copy(c.Writer, r)
 }
 
-func saveToDatabase(filename, thumbnailFilename, sha256sum string) error {
-	img, err := os.Open(filepath.Join(uploadDir, filename))
-	if err != nil {
-		return err
-	}
-	defer img.Close()
+func saveToDatabase(filename, thumbnailFilename, sha256sum string, dhash, phash uint64, width, height int, meta imageMetadata, format string, frames, durationMs int, animated bool) (int, error) {
+	var id int
+	err := db.QueryRow(
+		`INSERT INTO images
+			(filename, thumbnail_filename, width, height, sha256sum, dhash, phash,
+			 camera_make, camera_model, taken_at, gps_lat, gps_lon,
+			 format, frames, duration_ms, animated)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16)
+		RETURNING id`,
+		filename, thumbnailFilename, width, height, sha256sum, int64(dhash), int64(phash),
+		nullString(meta.CameraMake), nullString(meta.CameraModel), meta.TakenAt, meta.GPSLat, meta.GPSLon,
+		format, frames, durationMs, animated,
+	).Scan(&id)
+	return id, err
+}
 
-	config, _, err := image.DecodeConfig(img)
-	if err != nil {
-		return err
+// nullString turns an empty string into a SQL NULL instead of storing "".
+func nullString(s string) interface{} {
+	if s == "" {
+		return nil
 	}
-
-	_, err = db.Exec("INSERT INTO images (filename, thumbnail_filename, width, height, sha256sum) VALUES ($1, $2, $3, $4, $5)",
-		filename, thumbnailFilename, config.Width, config.Height, sha256sum)
-	return err
+	return s
 }
 
 func viewHandler(c *gin.Context) {
@@ -246,7 +403,8 @@ func viewHandler(c *gin.Context) {
 
 func getRecentImages(limit int) ([]ImageInfo, error) {
 	query := `
-		SELECT id, filename, thumbnail_filename, width, height, sha256sum, upload_date
+		SELECT id, filename, thumbnail_filename, width, height, sha256sum, upload_date,
+			format, frames, duration_ms, animated
 		FROM images
 		ORDER BY upload_date DESC
 		LIMIT $1
@@ -269,12 +427,20 @@ func getRecentImages(limit int) ([]ImageInfo, error) {
 			&img.Height,
 			&img.SHA256Sum,
 			&img.UploadDate,
+			&img.Format,
+			&img.Frames,
+			&img.DurationMs,
+			&img.Animated,
 		)
 		if err != nil {
 			return nil, err
 		}
-		img.ThumbnailPath = filepath.Join("/thumb", img.ThumbnailFilename)
-		img.ImagePath = filepath.Join("/image", img.Filename)
+		img.ThumbnailPath = objects.URL(thumbnailKey(img.ThumbnailFilename))
+		img.ImagePath = objects.URL(imageKey(img.Filename))
+		img.Variants, err = getVariantsForImage(img.ID)
+		if err != nil {
+			return nil, err
+		}
 		images = append(images, img)
 	}
 
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+type legacyFile struct {
+	filename          string
+	thumbnailFilename string
+}
+
+// migrateToShardedLayout moves any images and thumbnails still living in
+// the old flat layout (store.root/image/<file>, store.root/thumb/<file>)
+// into the sharded keys produced by imageKey/thumbnailKey. The images
+// table stores bare filenames, so the shard path is derived the same way
+// for old and new files and no column rewrite is required. Only meaningful
+// for local storage; S3-backed deployments never had a flat layout.
+func migrateToShardedLayout(store *localStorage) error {
+	rows, err := db.Query("SELECT filename, thumbnail_filename FROM images")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var files []legacyFile
+	for rows.Next() {
+		var f legacyFile
+		if err := rows.Scan(&f.filename, &f.thumbnailFilename); err != nil {
+			return err
+		}
+		files = append(files, f)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, f := range files {
+		if err := migrateFile(store.root, imagePrefix, f.filename); err != nil {
+			return fmt.Errorf("error migrating %s: %v", f.filename, err)
+		}
+		if err := migrateFile(store.root, thumbnailPrefix, f.thumbnailFilename); err != nil {
+			return fmt.Errorf("error migrating %s: %v", f.thumbnailFilename, err)
+		}
+	}
+
+	return nil
+}
+
+// migrateFile moves filename from its old flat location
+// (root/prefix/filename) to its sharded location
+// (root/prefix/<shard>/filename), if it is still at the old one.
+func migrateFile(root, prefix, filename string) error {
+	oldPath := filepath.Join(root, prefix, filename)
+	info, err := os.Stat(oldPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if info.IsDir() {
+		return nil
+	}
+
+	newPath := filepath.Join(root, filepath.FromSlash(path.Join(prefix, shardKey(filename))))
+	if err := os.MkdirAll(filepath.Dir(newPath), 0755); err != nil {
+		return err
+	}
+	return os.Rename(oldPath, newPath)
+}
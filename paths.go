@@ -0,0 +1,27 @@
+package main
+
+import "path"
+
+const (
+	imagePrefix     = "image"
+	thumbnailPrefix = "thumb"
+)
+
+// shardKey returns the two-level sharded storage key suffix for filename,
+// keyed off the first 4 hex characters of the content hash the filename
+// starts with (e.g. ab/cd/abcdef....jpg). filename is expected to be
+// "<sha256sum><ext>" as produced by processFile.
+func shardKey(filename string) string {
+	if len(filename) < 4 {
+		return filename
+	}
+	return path.Join(filename[0:2], filename[2:4], filename)
+}
+
+func imageKey(filename string) string {
+	return path.Join(imagePrefix, shardKey(filename))
+}
+
+func thumbnailKey(filename string) string {
+	return path.Join(thumbnailPrefix, shardKey(filename))
+}
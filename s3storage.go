@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+const defaultPresignExpiry = 15 * time.Minute
+
+// s3Storage stores objects in an S3-compatible bucket (AWS S3, MinIO,
+// etc.) via minio-go.
+type s3Storage struct {
+	client        *minio.Client
+	bucket        string
+	presignExpiry time.Duration
+}
+
+func newS3Storage(cfg StorageConfig) (*s3Storage, error) {
+	if cfg.Bucket == "" {
+		return nil, fmt.Errorf("storage: bucket is required for s3 storage")
+	}
+
+	client, err := minio.New(cfg.Endpoint, &minio.Options{
+		Creds:  credentials.NewStaticV4(cfg.AccessKey, cfg.SecretKey, ""),
+		Secure: cfg.UseSSL,
+		Region: cfg.Region,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error creating S3 client: %v", err)
+	}
+
+	expiry := defaultPresignExpiry
+	if cfg.PresignExpirySeconds > 0 {
+		expiry = time.Duration(cfg.PresignExpirySeconds) * time.Second
+	}
+
+	return &s3Storage{client: client, bucket: cfg.Bucket, presignExpiry: expiry}, nil
+}
+
+func (s *s3Storage) Put(ctx context.Context, key string, r io.Reader, contentType string) error {
+	_, err := s.client.PutObject(ctx, s.bucket, key, r, -1, minio.PutObjectOptions{ContentType: contentType})
+	return err
+}
+
+func (s *s3Storage) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	return s.client.GetObject(ctx, s.bucket, key, minio.GetObjectOptions{})
+}
+
+func (s *s3Storage) URL(key string) string {
+	u, err := s.client.PresignedGetObject(context.Background(), s.bucket, key, s.presignExpiry, nil)
+	if err != nil {
+		return ""
+	}
+	return u.String()
+}
@@ -0,0 +1,49 @@
+package main
+
+import "fmt"
+
+// ensureSchema applies idempotent schema migrations so the images table
+// stays in sync with the columns this binary expects, without requiring a
+// separate migration tool.
+func ensureSchema() error {
+	statements := []string{
+		`ALTER TABLE images ADD COLUMN IF NOT EXISTS dhash BIGINT`,
+		`ALTER TABLE images ADD COLUMN IF NOT EXISTS phash BIGINT`,
+		`ALTER TABLE images ADD COLUMN IF NOT EXISTS camera_make TEXT`,
+		`ALTER TABLE images ADD COLUMN IF NOT EXISTS camera_model TEXT`,
+		`ALTER TABLE images ADD COLUMN IF NOT EXISTS taken_at TIMESTAMP`,
+		`ALTER TABLE images ADD COLUMN IF NOT EXISTS gps_lat DOUBLE PRECISION`,
+		`ALTER TABLE images ADD COLUMN IF NOT EXISTS gps_lon DOUBLE PRECISION`,
+		`ALTER TABLE images ADD COLUMN IF NOT EXISTS format TEXT NOT NULL DEFAULT 'jpeg'`,
+		`ALTER TABLE images ADD COLUMN IF NOT EXISTS frames INTEGER NOT NULL DEFAULT 1`,
+		`ALTER TABLE images ADD COLUMN IF NOT EXISTS duration_ms INTEGER NOT NULL DEFAULT 0`,
+		`ALTER TABLE images ADD COLUMN IF NOT EXISTS animated BOOLEAN NOT NULL DEFAULT false`,
+		`CREATE TABLE IF NOT EXISTS pending_uploads (
+			id TEXT PRIMARY KEY,
+			byte_offset BIGINT NOT NULL,
+			length BIGINT NOT NULL,
+			sha256_running TEXT NOT NULL,
+			metadata TEXT,
+			created_at TIMESTAMP NOT NULL DEFAULT now(),
+			expires_at TIMESTAMP NOT NULL
+		)`,
+		`CREATE TABLE IF NOT EXISTS image_variants (
+			id SERIAL PRIMARY KEY,
+			image_id INTEGER NOT NULL REFERENCES images(id),
+			size INTEGER NOT NULL,
+			format TEXT NOT NULL,
+			width INTEGER NOT NULL,
+			height INTEGER NOT NULL,
+			bytes BIGINT NOT NULL,
+			filename TEXT NOT NULL
+		)`,
+	}
+
+	for _, stmt := range statements {
+		if _, err := db.Exec(stmt); err != nil {
+			return fmt.Errorf("error running schema migration: %v", err)
+		}
+	}
+
+	return nil
+}
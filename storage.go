@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Storage abstracts where object bytes live so uploads and serving can run
+// against local disk or an S3-compatible bucket without the rest of the
+// app knowing which.
+type Storage interface {
+	Put(ctx context.Context, key string, r io.Reader, contentType string) error
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	URL(key string) string
+}
+
+// newStorage builds the Storage backend selected by cfg.
+func newStorage(cfg StorageConfig) (Storage, error) {
+	switch cfg.Type {
+	case "", "local":
+		return newLocalStorage("."), nil
+	case "s3":
+		return newS3Storage(cfg)
+	default:
+		return nil, fmt.Errorf("unknown storage type %q", cfg.Type)
+	}
+}
+
+// localStorage stores objects under root on the local filesystem, using
+// the storage key as a root-relative path.
+type localStorage struct {
+	root string
+}
+
+func newLocalStorage(root string) *localStorage {
+	return &localStorage{root: root}
+}
+
+func (s *localStorage) Put(ctx context.Context, key string, r io.Reader, contentType string) error {
+	path := filepath.Join(s.root, filepath.FromSlash(key))
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	dst, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+
+	_, err = io.Copy(dst, r)
+	return err
+}
+
+func (s *localStorage) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	return os.Open(filepath.Join(s.root, filepath.FromSlash(key)))
+}
+
+func (s *localStorage) URL(key string) string {
+	return "/" + key
+}
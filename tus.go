@@ -0,0 +1,419 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	tusResumableVersion    = "1.0.0"
+	pendingDir             = "./pending"
+	pendingUploadTTL       = 24 * time.Hour
+	pendingJanitorInterval = 10 * time.Minute
+)
+
+// pendingUpload mirrors a row of the pending_uploads table: an in-progress
+// tus upload that hasn't been assembled into a finished file yet.
+type pendingUpload struct {
+	ID            string
+	Offset        int64
+	Length        int64
+	SHA256Running string
+	Metadata      string
+	ExpiresAt     time.Time
+}
+
+// tusCreateHandler implements "POST /files", the tus creation extension:
+// it registers a new upload of the declared Upload-Length and returns its
+// Location for subsequent PATCH requests.
+func tusCreateHandler(c *gin.Context) {
+	c.Header("Tus-Resumable", tusResumableVersion)
+
+	length, err := strconv.ParseInt(c.GetHeader("Upload-Length"), 10, 64)
+	if err != nil || length <= 0 {
+		c.Status(http.StatusBadRequest)
+		return
+	}
+	if length > maxUploadSize {
+		c.Status(http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	id, err := newUploadID()
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+
+	if err := createPendingUpload(id, length, c.GetHeader("Upload-Metadata")); err != nil {
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+
+	c.Header("Location", "/files/"+id)
+	c.Status(http.StatusCreated)
+}
+
+// tusOptionsHandler advertises protocol capabilities, per the tus OPTIONS
+// discovery convention.
+func tusOptionsHandler(c *gin.Context) {
+	c.Header("Tus-Resumable", tusResumableVersion)
+	c.Header("Tus-Version", tusResumableVersion)
+	c.Header("Tus-Extension", "creation,termination")
+	c.Header("Tus-Max-Size", strconv.FormatInt(maxUploadSize, 10))
+	c.Status(http.StatusNoContent)
+}
+
+// tusHeadHandler implements "HEAD /files/:id", reporting how many bytes of
+// the upload have been received so far.
+func tusHeadHandler(c *gin.Context) {
+	c.Header("Tus-Resumable", tusResumableVersion)
+
+	upload, err := getPendingUpload(c.Param("id"))
+	if err == sql.ErrNoRows {
+		c.Status(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+
+	c.Header("Cache-Control", "no-store")
+	c.Header("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	c.Header("Upload-Length", strconv.FormatInt(upload.Length, 10))
+	c.Status(http.StatusOK)
+}
+
+// tusPatchHandler implements "PATCH /files/:id": it appends the request
+// body to the upload's scratch file starting at Upload-Offset, updates the
+// running SHA-256 and persisted offset atomically, and once the upload is
+// complete runs it through the regular processFile ingest pipeline. The
+// read-offset/write-chunk/update-offset sequence runs with the
+// pending_uploads row locked via SELECT ... FOR UPDATE, so two concurrent
+// PATCH requests for the same id (a client retry racing the original, or a
+// buggy client sending overlapping chunks) serialize instead of both
+// writing to the scratch file at the same offset.
+func tusPatchHandler(c *gin.Context) {
+	c.Header("Tus-Resumable", tusResumableVersion)
+
+	if c.GetHeader("Content-Type") != "application/offset+octet-stream" {
+		c.Status(http.StatusUnsupportedMediaType)
+		return
+	}
+
+	id := c.Param("id")
+
+	tx, err := db.Begin()
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	upload, err := getPendingUploadForUpdate(tx, id)
+	if err == sql.ErrNoRows {
+		c.Status(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+
+	if upload.ExpiresAt.Before(time.Now()) {
+		tx.Rollback()
+		cleanupPendingUpload(id)
+		c.Status(http.StatusGone)
+		return
+	}
+
+	clientOffset, err := strconv.ParseInt(c.GetHeader("Upload-Offset"), 10, 64)
+	if err != nil {
+		c.Status(http.StatusBadRequest)
+		return
+	}
+	if clientOffset != upload.Offset {
+		c.Status(http.StatusConflict)
+		return
+	}
+
+	running, err := restoreHashState(upload.SHA256Running)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+
+	f, err := os.OpenFile(pendingFilePath(id), os.O_WRONLY, 0644)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+
+	if _, err := f.Seek(upload.Offset, io.SeekStart); err != nil {
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+
+	// Enforce maxUploadSize incrementally: never accept more bytes than
+	// remain before the declared Upload-Length.
+	remaining := upload.Length - upload.Offset
+	n, err := io.Copy(io.MultiWriter(f, running), io.LimitReader(c.Request.Body, remaining))
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+
+	newOffset := upload.Offset + n
+
+	state, err := marshalHashState(running)
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+
+	if _, err := tx.Exec(
+		"UPDATE pending_uploads SET byte_offset = $1, sha256_running = $2 WHERE id = $3",
+		newOffset, state, id,
+	); err != nil {
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+
+	c.Header("Upload-Offset", strconv.FormatInt(newOffset, 10))
+
+	if newOffset < upload.Length {
+		c.Status(http.StatusNoContent)
+		return
+	}
+
+	response, statusCode := finishPendingUpload(id, upload.Metadata)
+	c.JSON(statusCode, response)
+}
+
+// tusDeleteHandler implements "DELETE /files/:id", the tus termination
+// extension: it discards the in-progress upload.
+func tusDeleteHandler(c *gin.Context) {
+	c.Header("Tus-Resumable", tusResumableVersion)
+
+	id := c.Param("id")
+	if _, err := getPendingUpload(id); err == sql.ErrNoRows {
+		c.Status(http.StatusNotFound)
+		return
+	} else if err != nil {
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+
+	cleanupPendingUpload(id)
+	c.Status(http.StatusNoContent)
+}
+
+// finishPendingUpload runs a completed tus upload through the same ingest
+// pipeline as a regular multipart upload, then discards the pending record
+// regardless of outcome.
+func finishPendingUpload(id, metadata string) (gin.H, int) {
+	defer cleanupPendingUpload(id)
+
+	f, err := os.Open(pendingFilePath(id))
+	if err != nil {
+		return gin.H{"error": "Failed to read completed upload"}, http.StatusInternalServerError
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return gin.H{"error": "Failed to read completed upload"}, http.StatusInternalServerError
+	}
+
+	response, statusCode := processFile(f, info.Size(), uploadMetadataFilename(metadata))
+	response["filename"] = uploadMetadataFilename(metadata)
+	return response, statusCode
+}
+
+// createPendingUpload allocates the scratch file and pending_uploads row
+// for a new tus upload.
+func createPendingUpload(id string, length int64, metadata string) error {
+	if err := os.MkdirAll(pendingDir, 0755); err != nil {
+		return err
+	}
+
+	f, err := os.Create(pendingFilePath(id))
+	if err != nil {
+		return err
+	}
+	f.Close()
+
+	state, err := marshalHashState(sha256.New())
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(
+		`INSERT INTO pending_uploads (id, byte_offset, length, sha256_running, metadata, expires_at)
+		VALUES ($1, 0, $2, $3, $4, $5)`,
+		id, length, state, metadata, time.Now().Add(pendingUploadTTL),
+	)
+	return err
+}
+
+func getPendingUpload(id string) (*pendingUpload, error) {
+	var u pendingUpload
+	err := db.QueryRow(
+		"SELECT id, byte_offset, length, sha256_running, metadata, expires_at FROM pending_uploads WHERE id = $1",
+		id,
+	).Scan(&u.ID, &u.Offset, &u.Length, &u.SHA256Running, &u.Metadata, &u.ExpiresAt)
+	if err != nil {
+		return nil, err
+	}
+	return &u, nil
+}
+
+// getPendingUploadForUpdate is getPendingUpload run inside tx with a row
+// lock, so the caller can read-modify-write Offset without racing a
+// concurrent PATCH for the same upload id.
+func getPendingUploadForUpdate(tx *sql.Tx, id string) (*pendingUpload, error) {
+	var u pendingUpload
+	err := tx.QueryRow(
+		"SELECT id, byte_offset, length, sha256_running, metadata, expires_at FROM pending_uploads WHERE id = $1 FOR UPDATE",
+		id,
+	).Scan(&u.ID, &u.Offset, &u.Length, &u.SHA256Running, &u.Metadata, &u.ExpiresAt)
+	if err != nil {
+		return nil, err
+	}
+	return &u, nil
+}
+
+// cleanupPendingUpload removes both halves of a pending upload's state: the
+// scratch file and the database row. Errors are logged rather than
+// returned since callers invoke this as best-effort cleanup.
+func cleanupPendingUpload(id string) {
+	if err := os.Remove(pendingFilePath(id)); err != nil && !os.IsNotExist(err) {
+		log.Printf("error removing pending upload file %s: %v", id, err)
+	}
+	if _, err := db.Exec("DELETE FROM pending_uploads WHERE id = $1", id); err != nil {
+		log.Printf("error removing pending upload row %s: %v", id, err)
+	}
+}
+
+func pendingFilePath(id string) string {
+	return filepath.Join(pendingDir, id)
+}
+
+// runPendingUploadJanitor periodically deletes expired pending uploads so
+// abandoned tus sessions don't accumulate scratch files or rows forever.
+func runPendingUploadJanitor(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if err := cleanupExpiredUploads(); err != nil {
+			log.Printf("error cleaning up expired uploads: %v", err)
+		}
+	}
+}
+
+func cleanupExpiredUploads() error {
+	rows, err := db.Query("SELECT id FROM pending_uploads WHERE expires_at < now()")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return err
+		}
+		ids = append(ids, id)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		cleanupPendingUpload(id)
+	}
+	return nil
+}
+
+// newUploadID generates a random hex identifier for a new pending upload.
+func newUploadID() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// marshalHashState and restoreHashState persist a sha256 hasher's internal
+// state between PATCH requests, so resuming an upload doesn't require
+// re-reading the bytes already received.
+func marshalHashState(h hash.Hash) (string, error) {
+	marshaler, ok := h.(encoding.BinaryMarshaler)
+	if !ok {
+		return "", errors.New("hash does not support state serialization")
+	}
+	b, err := marshaler.MarshalBinary()
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func restoreHashState(state string) (hash.Hash, error) {
+	h := sha256.New()
+	b, err := hex.DecodeString(state)
+	if err != nil {
+		return nil, err
+	}
+	unmarshaler, ok := h.(encoding.BinaryUnmarshaler)
+	if !ok {
+		return nil, errors.New("hash does not support state serialization")
+	}
+	if err := unmarshaler.UnmarshalBinary(b); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// uploadMetadataFilename extracts the "filename" key from a tus
+// Upload-Metadata header, which encodes comma-separated "key base64value"
+// pairs.
+func uploadMetadataFilename(header string) string {
+	for _, pair := range strings.Split(header, ",") {
+		kv := strings.SplitN(strings.TrimSpace(pair), " ", 2)
+		if len(kv) != 2 || kv[0] != "filename" {
+			continue
+		}
+		decoded, err := base64.StdEncoding.DecodeString(kv[1])
+		if err != nil {
+			continue
+		}
+		return string(decoded)
+	}
+	return ""
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"image/gif"
+	"io"
+	"path/filepath"
+	"strings"
+
+	"github.com/chai2010/webp"
+	"github.com/disintegration/imaging"
+)
+
+// VariantSpec describes one thumbnail size to generate, and the set of
+// encodings to produce it in.
+type VariantSpec struct {
+	Size    int      `yaml:"size"`
+	Formats []string `yaml:"formats"`
+}
+
+// defaultVariantSpecs is used when config.yaml does not define
+// thumbnails.variants.
+var defaultVariantSpecs = []VariantSpec{
+	{Size: 120, Formats: []string{"jpeg", "webp"}},
+	{Size: 400, Formats: []string{"jpeg", "webp"}},
+	{Size: 800, Formats: []string{"jpeg", "webp"}},
+	{Size: 1600, Formats: []string{"jpeg", "webp"}},
+}
+
+// Variant is one generated thumbnail size/format pair, as stored in the
+// image_variants table.
+type Variant struct {
+	Size     int    `json:"size"`
+	Format   string `json:"format"`
+	Filename string `json:"-"`
+	Width    int    `json:"width"`
+	Height   int    `json:"height"`
+	Bytes    int64  `json:"bytes"`
+	Path     string `json:"path"`
+}
+
+// generateVariants resizes the uploaded image to every configured variant
+// size, encodes each in its configured formats, and stores them under
+// thumbnailKey. It also returns the smallest JPEG variant's filename so it
+// can keep populating the legacy thumbnail_filename column. An animated
+// .gif upload instead gets a single animated GIF thumbnail at the smallest
+// configured size (see generateAnimatedGIFThumbnail), and that GIF's
+// filename is returned.
+func generateVariants(filename string) ([]Variant, string, error) {
+	ctx := context.Background()
+
+	r, err := objects.Get(ctx, imageKey(filename))
+	if err != nil {
+		return nil, "", err
+	}
+	defer r.Close()
+
+	raw, err := io.ReadAll(r)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if strings.ToLower(filepath.Ext(filename)) == ".gif" {
+		if g, err := gif.DecodeAll(bytes.NewReader(raw)); err == nil && len(g.Image) > 1 {
+			return generateAnimatedGIFThumbnail(filename, g)
+		}
+		// Single-frame GIF: fall through to the regular static pipeline.
+	}
+
+	src, err := imaging.Decode(bytes.NewReader(raw))
+	if err != nil {
+		return nil, "", err
+	}
+
+	specs := cfg.Thumbnails.Variants
+	if len(specs) == 0 {
+		specs = defaultVariantSpecs
+	}
+
+	base := strings.TrimSuffix(filepath.Base(filename), filepath.Ext(filename))
+
+	var variants []Variant
+	for _, spec := range specs {
+		resized := resizeLongEdge(src, spec.Size)
+		bounds := resized.Bounds()
+
+		for _, format := range spec.Formats {
+			encoded, err := encodeVariant(resized, format)
+			if err != nil {
+				return nil, "", err
+			}
+
+			variantFilename := fmt.Sprintf("%s_%d.%s", base, spec.Size, variantExt(format))
+			if err := objects.Put(ctx, thumbnailKey(variantFilename), bytes.NewReader(encoded), variantContentType(format)); err != nil {
+				return nil, "", err
+			}
+
+			variants = append(variants, Variant{
+				Size:     spec.Size,
+				Format:   format,
+				Filename: variantFilename,
+				Width:    bounds.Dx(),
+				Height:   bounds.Dy(),
+				Bytes:    int64(len(encoded)),
+			})
+		}
+	}
+
+	return variants, legacyThumbnailFilename(variants), nil
+}
+
+// legacyThumbnailFilename picks the smallest JPEG variant so the existing
+// thumbnail_filename column keeps pointing at a sensible default thumbnail.
+func legacyThumbnailFilename(variants []Variant) string {
+	filename := ""
+	smallest := 0
+	for _, v := range variants {
+		if v.Format != "jpeg" {
+			continue
+		}
+		if filename == "" || v.Size < smallest {
+			filename = v.Filename
+			smallest = v.Size
+		}
+	}
+	return filename
+}
+
+func resizeLongEdge(img image.Image, size int) image.Image {
+	b := img.Bounds()
+	if b.Dx() >= b.Dy() {
+		return imaging.Resize(img, size, 0, imaging.Lanczos)
+	}
+	return imaging.Resize(img, 0, size, imaging.Lanczos)
+}
+
+func encodeVariant(img image.Image, format string) ([]byte, error) {
+	var buf bytes.Buffer
+	switch format {
+	case "jpeg":
+		if err := imaging.Encode(&buf, img, imaging.JPEG); err != nil {
+			return nil, err
+		}
+	case "webp":
+		if err := webp.Encode(&buf, img, &webp.Options{Quality: 80}); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unsupported variant format %q", format)
+	}
+	return buf.Bytes(), nil
+}
+
+func variantExt(format string) string {
+	if format == "webp" {
+		return "webp"
+	}
+	return "jpg"
+}
+
+func variantContentType(format string) string {
+	if format == "webp" {
+		return "image/webp"
+	}
+	return "image/jpeg"
+}
+
+// saveVariants persists the variants generated for imageID.
+func saveVariants(imageID int, variants []Variant) error {
+	for _, v := range variants {
+		_, err := db.Exec(
+			"INSERT INTO image_variants (image_id, size, format, width, height, bytes, filename) VALUES ($1, $2, $3, $4, $5, $6, $7)",
+			imageID, v.Size, v.Format, v.Width, v.Height, v.Bytes, v.Filename,
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// getVariantsForImage returns the stored variants for imageID, smallest
+// first, with Path resolved against the active storage backend.
+func getVariantsForImage(imageID int) ([]Variant, error) {
+	rows, err := db.Query(
+		"SELECT size, format, width, height, bytes, filename FROM image_variants WHERE image_id = $1 ORDER BY size ASC",
+		imageID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var variants []Variant
+	for rows.Next() {
+		var v Variant
+		if err := rows.Scan(&v.Size, &v.Format, &v.Width, &v.Height, &v.Bytes, &v.Filename); err != nil {
+			return nil, err
+		}
+		v.Path = objects.URL(thumbnailKey(v.Filename))
+		variants = append(variants, v)
+	}
+
+	return variants, rows.Err()
+}